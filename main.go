@@ -1,22 +1,39 @@
 package dns
 
 import (
+	"bytes"
 	"context"
-	"encoding/json"
+	"crypto/tls"
 	"fmt"
+	"io"
 	"net"
+	"net/http"
+	"regexp"
 	"slices"
+	"strconv"
 	"strings"
+	"sync"
 
+	"github.com/miekg/dns"
 	"github.com/scorify/schema"
 )
 
 type Schema struct {
+	// Server is a single host or, for the multi-server failover/quorum
+	// strategies, a comma-separated list of hosts (e.g. "1.1.1.1,8.8.8.8").
+	// Run does not query it when Authoritative is true, though Validate
+	// still requires it to be non-empty.
 	Server         string `key:"dns_server"`
-	Port           int    `key:"port" default:"53"`
-	Record         string `key:"record" default:"A" enum:"A,AAAA,CNAME,MX,NS,PTR,TXT"`
+	Port           int    `key:"port"`
+	Protocol       string `key:"protocol" default:"udp" enum:"udp,tcp,dot,doh"`
+	Record         string `key:"record" default:"A" enum:"A,AAAA,CNAME,MX,NS,PTR,TXT,SRV,CAA,SOA,TLSA"`
 	Domain         string `key:"domain"`
 	ExpectedOutput string `key:"expected_output"`
+	MatchMode      string `key:"match_mode" default:"exact" enum:"exact,regex,contains,cidr"`
+	Authoritative  bool   `key:"authoritative" default:"false"`
+	// Strategy is "first-success", "all", or "quorum:N" where N is the
+	// minimum number of servers that must agree.
+	Strategy string `key:"strategy" default:"all"`
 }
 
 func Validate(config string) error {
@@ -31,8 +48,16 @@ func Validate(config string) error {
 		return fmt.Errorf("server is required; got %q", conf.Server)
 	}
 
+	if conf.Protocol == "" {
+		conf.Protocol = "udp"
+	}
+
+	if !slices.Contains([]string{"udp", "tcp", "dot", "doh"}, conf.Protocol) {
+		return fmt.Errorf("protocol must be one of udp, tcp, dot, doh; got %q", conf.Protocol)
+	}
+
 	if conf.Port == 0 {
-		return fmt.Errorf("port is required; got %d", conf.Port)
+		conf.Port = defaultPort(conf.Protocol)
 	}
 
 	if conf.Port < 1 || conf.Port > 65535 {
@@ -43,8 +68,8 @@ func Validate(config string) error {
 		return fmt.Errorf("record is required; got %q", conf.Record)
 	}
 
-	if !slices.Contains([]string{"A", "AAAA", "CNAME", "MX", "NS", "PTR", "TXT"}, conf.Record) {
-		return fmt.Errorf("record must be one of A, AAAA, CNAME, MX, NS, PTR, TXT; got %q", conf.Record)
+	if _, err := recordType(conf.Record); err != nil {
+		return err
 	}
 
 	if conf.Domain == "" {
@@ -55,108 +80,533 @@ func Validate(config string) error {
 		return fmt.Errorf("expected_output is required; got %q", conf.ExpectedOutput)
 	}
 
+	if conf.MatchMode == "" {
+		conf.MatchMode = "exact"
+	}
+
+	switch conf.MatchMode {
+	case "exact", "contains":
+	case "regex":
+		if _, err := regexp.Compile(conf.ExpectedOutput); err != nil {
+			return fmt.Errorf("expected_output is not a valid regexp: %w", err)
+		}
+	case "cidr":
+		if conf.Record != "A" && conf.Record != "AAAA" {
+			return fmt.Errorf("match_mode cidr is only valid for A and AAAA records; got %q", conf.Record)
+		}
+
+		if _, _, err := net.ParseCIDR(conf.ExpectedOutput); err != nil {
+			return fmt.Errorf("expected_output is not a valid CIDR block: %w", err)
+		}
+	default:
+		return fmt.Errorf("match_mode must be one of exact, regex, contains, cidr; got %q", conf.MatchMode)
+	}
+
+	if conf.Authoritative {
+		if conf.Strategy != "" && conf.Strategy != "all" {
+			return fmt.Errorf("strategy must be \"all\" when authoritative is true; got %q", conf.Strategy)
+		}
+	} else {
+		serverCount := len(splitServers(conf.Server))
+		if serverCount == 0 {
+			return fmt.Errorf("server must contain at least one host; got %q", conf.Server)
+		}
+
+		if _, _, err := parseStrategy(conf.Strategy, serverCount); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
 func Run(ctx context.Context, config string) error {
-	schema := Schema{}
+	conf := Schema{}
 
-	err := json.Unmarshal([]byte(config), &schema)
+	err := schema.Unmarshal([]byte(config), &conf)
 	if err != nil {
 		return err
 	}
 
-	connStr := fmt.Sprintf("%s:%d", schema.Server, schema.Port)
+	if conf.Port == 0 {
+		conf.Port = defaultPort(conf.Protocol)
+	}
+
+	matches, err := buildMatcher(conf)
+	if err != nil {
+		return err
+	}
 
-	r := new(net.Resolver)
-	r.Dial = func(ctx context.Context, network, address string) (net.Conn, error) {
-		deadline, ok := ctx.Deadline()
-		if !ok {
-			return nil, fmt.Errorf("deadline not set")
+	var servers []serverSpec
+	if conf.Authoritative {
+		servers, err = discoverAuthoritativeServers(ctx, conf.Domain)
+		if err != nil {
+			return err
+		}
+	} else {
+		for _, host := range splitServers(conf.Server) {
+			servers = append(servers, serverSpec{host: host})
 		}
 
-		d := net.Dialer{
-			Deadline: deadline,
+		if len(servers) == 0 {
+			return fmt.Errorf("server must contain at least one host; got %q", conf.Server)
 		}
+	}
 
-		return d.DialContext(ctx, network, connStr)
+	strategy := conf.Strategy
+	if conf.Authoritative {
+		// Authoritative mode only makes sense if every authoritative
+		// server agrees; it ignores any other configured strategy.
+		strategy = "all"
 	}
 
-	var addresses []string
+	strategyKind, quorumN, err := parseStrategy(strategy, len(servers))
+	if err != nil {
+		return err
+	}
 
-	switch schema.Record {
-	case "A":
-		ips, err := r.LookupIP(ctx, "ip4", schema.Domain)
-		if err != nil {
-			return err
+	return dispatch(ctx, conf, servers, strategyKind, quorumN, matches)
+}
+
+// serverSpec is one server to query: host is used for display, TLS SNI, and
+// DoH URLs; addr, when set, is the literal address actually dialed (used by
+// authoritative mode, which resolves each NS hostname to an IP ahead of
+// time but must still present the hostname for certificate validation).
+type serverSpec struct {
+	host string
+	addr string
+}
+
+// serverResult records the outcome of querying a single server, so a
+// failing strategy can report exactly which servers disagreed.
+type serverResult struct {
+	server string
+	err    error
+}
+
+// dispatch queries every server concurrently, each under its own context
+// derived from the caller's deadline, and evaluates the results against the
+// configured strategy: "first-success" succeeds as soon as one server
+// matches, "all" requires every server to match, and "quorum" requires at
+// least quorumN servers to match.
+func dispatch(ctx context.Context, schema Schema, servers []serverSpec, strategy string, quorumN int, matches func(string) bool) error {
+	resultCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([]serverResult, len(servers))
+
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		wg.Add(1)
+		go func(i int, server serverSpec) {
+			defer wg.Done()
+
+			serverCtx, serverCancel := context.WithCancel(resultCtx)
+			defer serverCancel()
+
+			target := schema
+			target.Server = server.host
+
+			err := queryAndMatch(serverCtx, target, server.addr, matches)
+			results[i] = serverResult{server: server.host, err: err}
+
+			if err == nil && strategy == "first-success" {
+				cancel()
+			}
+		}(i, server)
+	}
+	wg.Wait()
+
+	successCount := 0
+	for _, result := range results {
+		if result.err == nil {
+			successCount++
 		}
+	}
 
-		addresses = make([]string, len(ips))
-		for i, ip := range ips {
-			addresses[i] = ip.String()
+	switch strategy {
+	case "first-success":
+		if successCount > 0 {
+			return nil
 		}
-	case "AAAA":
-		ips, err := r.LookupIP(ctx, "ip6", schema.Domain)
-		if err != nil {
-			return err
+		return fmt.Errorf("no server succeeded:\n%s", formatServerResults(results))
+	case "quorum":
+		if successCount >= quorumN {
+			return nil
+		}
+		return fmt.Errorf("quorum of %d not met, only %d of %d servers succeeded:\n%s", quorumN, successCount, len(servers), formatServerResults(results))
+	default: // "all"
+		if successCount == len(servers) {
+			return nil
 		}
+		return fmt.Errorf("%d of %d servers failed:\n%s", len(servers)-successCount, len(servers), formatServerResults(results))
+	}
+}
+
+// queryAndMatch queries a single server and reports whether its answers
+// satisfy matches, returning a descriptive error otherwise. dialAddr, when
+// non-empty, is the literal address to dial instead of schema.Server.
+func queryAndMatch(ctx context.Context, schema Schema, dialAddr string, matches func(string) bool) error {
+	answers, err := query(ctx, schema, dialAddr)
+	if err != nil {
+		return err
+	}
 
-		addresses = make([]string, len(ips))
-		for i, ip := range ips {
-			addresses[i] = ip.String()
+	for _, answer := range answers {
+		if matches(answer) {
+			return nil
 		}
-	case "CNAME":
-		cname, err := r.LookupCNAME(ctx, schema.Domain)
-		if err != nil {
-			return err
+	}
+
+	return fmt.Errorf("expected output %q not found in [%s]", schema.ExpectedOutput, strings.Join(answers, ", "))
+}
+
+func formatServerResults(results []serverResult) string {
+	lines := make([]string, len(results))
+	for i, result := range results {
+		status := "ok"
+		if result.err != nil {
+			status = result.err.Error()
 		}
+		lines[i] = fmt.Sprintf("  %s: %s", result.server, status)
+	}
 
-		addresses = []string{cname}
-	case "MX":
-		mxs, err := r.LookupMX(ctx, schema.Domain)
-		if err != nil {
-			return err
+	return strings.Join(lines, "\n")
+}
+
+// dialAddress returns the literal host:port to dial: dialAddr when set (an
+// authoritative server resolved ahead of time to an IP), otherwise Server.
+func dialAddress(schema Schema, dialAddr string) string {
+	host := schema.Server
+	if dialAddr != "" {
+		host = dialAddr
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(schema.Port))
+}
+
+// defaultPort returns the conventional port for protocol, used whenever Port
+// is left unset by the caller.
+func defaultPort(protocol string) int {
+	switch protocol {
+	case "dot":
+		return 853
+	case "doh":
+		return 443
+	default:
+		return 53
+	}
+}
+
+// splitServers parses Server as a comma-separated host list, trimming
+// whitespace around each entry.
+func splitServers(server string) []string {
+	parts := strings.Split(server, ",")
+	servers := make([]string, 0, len(parts))
+	for _, part := range parts {
+		if trimmed := strings.TrimSpace(part); trimmed != "" {
+			servers = append(servers, trimmed)
+		}
+	}
+
+	return servers
+}
+
+// parseStrategy validates Strategy and, for "quorum:N", extracts N.
+func parseStrategy(strategy string, serverCount int) (string, int, error) {
+	if strategy == "" {
+		strategy = "all"
+	}
+
+	if strategy == "first-success" || strategy == "all" {
+		return strategy, 0, nil
+	}
+
+	n, ok := strings.CutPrefix(strategy, "quorum:")
+	if !ok {
+		return "", 0, fmt.Errorf("strategy must be one of first-success, all, quorum:N; got %q", strategy)
+	}
+
+	quorumN, err := strconv.Atoi(n)
+	if err != nil || quorumN < 1 {
+		return "", 0, fmt.Errorf("strategy quorum count must be a positive integer; got %q", strategy)
+	}
+
+	if serverCount > 0 && quorumN > serverCount {
+		return "", 0, fmt.Errorf("strategy quorum count %d exceeds number of servers (%d)", quorumN, serverCount)
+	}
+
+	return "quorum", quorumN, nil
+}
+
+// query dispatches to the transport selected by schema.Protocol. dialAddr,
+// when non-empty, is the literal address to dial instead of schema.Server
+// (used by authoritative mode, which resolves the NS hostname ahead of time
+// but must keep presenting that hostname for TLS SNI / DoH URLs).
+func query(ctx context.Context, schema Schema, dialAddr string) ([]string, error) {
+	switch schema.Protocol {
+	case "dot":
+		return queryDoT(ctx, schema, dialAddr)
+	case "doh":
+		return queryDoH(ctx, schema, dialAddr)
+	default:
+		return queryPlain(ctx, schema, dialAddr)
+	}
+}
+
+// discoverAuthoritativeServers walks up the domain from the full FQDN,
+// looking up NS records one label at a time until a zone cut is found, then
+// resolves each authoritative name server to an IP address so it can be
+// queried directly, bypassing any recursive resolver. The NS hostname is
+// kept alongside the resolved IP so TLS-based transports can still present
+// it for SNI and certificate validation.
+func discoverAuthoritativeServers(ctx context.Context, domain string) ([]serverSpec, error) {
+	zone := dns.Fqdn(domain)
+
+	var nameservers []*net.NS
+	for {
+		nss, err := net.DefaultResolver.LookupNS(ctx, zone)
+		if err == nil && len(nss) > 0 {
+			nameservers = nss
+			break
 		}
 
-		addresses = make([]string, len(mxs))
-		for i, mx := range mxs {
-			addresses[i] = mx.Host
+		labels := strings.SplitN(zone, ".", 2)
+		if len(labels) < 2 || labels[1] == "" || labels[1] == "." {
+			return nil, fmt.Errorf("no authoritative name servers found for %q", domain)
 		}
-	case "NS":
-		nss, err := r.LookupNS(ctx, schema.Domain)
+
+		zone = labels[1]
+	}
+
+	servers := make([]serverSpec, 0, len(nameservers))
+	for _, ns := range nameservers {
+		ips, err := net.DefaultResolver.LookupIP(ctx, "ip", ns.Host)
 		if err != nil {
-			return err
+			return nil, fmt.Errorf("resolving authoritative server %q: %w", ns.Host, err)
 		}
 
-		addresses = make([]string, len(nss))
-		for i, ns := range nss {
-			addresses[i] = ns.Host
+		if len(ips) == 0 {
+			return nil, fmt.Errorf("no addresses found for authoritative server %q", ns.Host)
 		}
-	case "PTR":
-		ptrs, err := r.LookupAddr(ctx, schema.Domain)
+
+		servers = append(servers, serverSpec{host: ns.Host, addr: ips[0].String()})
+	}
+
+	return servers, nil
+}
+
+// buildMatcher returns a predicate implementing the configured MatchMode,
+// pre-compiling the regexp or CIDR block so Run fails fast on a bad config
+// instead of on every answer.
+func buildMatcher(schema Schema) (func(string) bool, error) {
+	switch schema.MatchMode {
+	case "regex":
+		re, err := regexp.Compile(schema.ExpectedOutput)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		addresses = make([]string, len(ptrs))
-		copy(addresses, ptrs)
-	case "TXT":
-		txts, err := r.LookupTXT(ctx, schema.Domain)
+		return re.MatchString, nil
+	case "contains":
+		return func(answer string) bool {
+			return strings.Contains(answer, schema.ExpectedOutput)
+		}, nil
+	case "cidr":
+		_, network, err := net.ParseCIDR(schema.ExpectedOutput)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		addresses = make([]string, len(txts))
-		copy(addresses, txts)
+		return func(answer string) bool {
+			ip := net.ParseIP(answer)
+			return ip != nil && network.Contains(ip)
+		}, nil
 	default:
-		return fmt.Errorf("unsupported record type: %s", schema.Record)
+		return func(answer string) bool {
+			return answer == schema.ExpectedOutput
+		}, nil
 	}
+}
 
-	for _, address := range addresses {
-		if address == schema.ExpectedOutput {
-			return nil
+// queryPlain handles the "udp" and "tcp" protocols, falling back from UDP to
+// TCP when the response comes back truncated.
+func queryPlain(ctx context.Context, schema Schema, dialAddr string) ([]string, error) {
+	query, qType, err := buildQuery(schema.Domain, schema.Record)
+	if err != nil {
+		return nil, err
+	}
+
+	network := schema.Protocol
+	if network == "" {
+		network = "udp"
+	}
+
+	client := &dns.Client{Net: network}
+
+	resp, _, err := client.ExchangeContext(ctx, query, dialAddress(schema, dialAddr))
+	if err != nil {
+		return nil, err
+	}
+
+	if network == "udp" && resp.Truncated {
+		client.Net = "tcp"
+		resp, _, err = client.ExchangeContext(ctx, query, dialAddress(schema, dialAddr))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return formatAnswers(resp, qType)
+}
+
+// queryDoT issues the configured record query over DNS-over-TLS (RFC 7858):
+// a TLS connection to Server:Port with ServerName set to Server.
+func queryDoT(ctx context.Context, schema Schema, dialAddr string) ([]string, error) {
+	query, qType, err := buildQuery(schema.Domain, schema.Record)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &dns.Client{
+		Net: "tcp-tls",
+		TLSConfig: &tls.Config{
+			ServerName: schema.Server,
+		},
+	}
+
+	resp, _, err := client.ExchangeContext(ctx, query, dialAddress(schema, dialAddr))
+	if err != nil {
+		return nil, err
+	}
+
+	return formatAnswers(resp, qType)
+}
+
+// queryDoH issues the configured record query over DNS-over-HTTPS (RFC
+// 8484), POSTing the raw DNS message to https://Server[:Port]/dns-query.
+func queryDoH(ctx context.Context, schema Schema, dialAddr string) ([]string, error) {
+	query, qType, err := buildQuery(schema.Domain, schema.Record)
+	if err != nil {
+		return nil, err
+	}
+
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	url := fmt.Sprintf("https://%s:%d/dns-query", schema.Server, schema.Port)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	client := http.DefaultClient
+	if dialAddr != "" {
+		// Dial the resolved authoritative IP directly, but leave the
+		// request's Host (and therefore the TLS SNI) set to schema.Server
+		// so certificate validation still matches the server's hostname.
+		addr := dialAddress(schema, dialAddr)
+		client = &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, network, addr)
+				},
+			},
+		}
+	}
+
+	httpResp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh query failed: unexpected status %q", httpResp.Status)
+	}
+
+	body, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := new(dns.Msg)
+	if err := resp.Unpack(body); err != nil {
+		return nil, err
+	}
+
+	return formatAnswers(resp, qType)
+}
+
+func recordType(record string) (uint16, error) {
+	qType, ok := dns.StringToType[record]
+	if !ok {
+		return 0, fmt.Errorf("record must be one of A, AAAA, CNAME, MX, NS, PTR, TXT, SRV, CAA, SOA, TLSA; got %q", record)
+	}
+
+	switch qType {
+	case dns.TypeA, dns.TypeAAAA, dns.TypeCNAME, dns.TypeMX, dns.TypeNS, dns.TypePTR, dns.TypeTXT, dns.TypeSRV, dns.TypeCAA, dns.TypeSOA, dns.TypeTLSA:
+		return qType, nil
+	default:
+		return 0, fmt.Errorf("record must be one of A, AAAA, CNAME, MX, NS, PTR, TXT, SRV, CAA, SOA, TLSA; got %q", record)
+	}
+}
+
+func buildQuery(domain, record string) (*dns.Msg, uint16, error) {
+	qType, err := recordType(record)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(domain), qType)
+	msg.RecursionDesired = true
+
+	return msg, qType, nil
+}
+
+// formatAnswers renders every answer RR matching qType into its canonical
+// string form, e.g. "10 5 5060 sip.example.com." for SRV or
+// `0 issue "letsencrypt.org"` for CAA.
+func formatAnswers(resp *dns.Msg, qType uint16) ([]string, error) {
+	answers := make([]string, 0, len(resp.Answer))
+
+	for _, rr := range resp.Answer {
+		if rr.Header().Rrtype != qType {
+			continue
+		}
+
+		switch record := rr.(type) {
+		case *dns.A:
+			answers = append(answers, record.A.String())
+		case *dns.AAAA:
+			answers = append(answers, record.AAAA.String())
+		case *dns.CNAME:
+			answers = append(answers, record.Target)
+		case *dns.MX:
+			answers = append(answers, record.Mx)
+		case *dns.NS:
+			answers = append(answers, record.Ns)
+		case *dns.PTR:
+			answers = append(answers, record.Ptr)
+		case *dns.TXT:
+			answers = append(answers, strings.Join(record.Txt, ""))
+		case *dns.SRV:
+			answers = append(answers, fmt.Sprintf("%d %d %d %s", record.Priority, record.Weight, record.Port, record.Target))
+		case *dns.CAA:
+			answers = append(answers, fmt.Sprintf("%d %s %q", record.Flag, record.Tag, record.Value))
+		case *dns.SOA:
+			answers = append(answers, fmt.Sprintf("%s %s %d", record.Ns, record.Mbox, record.Serial))
+		case *dns.TLSA:
+			answers = append(answers, fmt.Sprintf("%d %d %d %s", record.Usage, record.Selector, record.MatchingType, record.Certificate))
 		}
 	}
 
-	return fmt.Errorf("expected out %q not found in [%s]", schema.ExpectedOutput, strings.Join(addresses, ", "))
+	return answers, nil
 }